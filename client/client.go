@@ -5,14 +5,21 @@
 package client
 
 import (
+	"crypto/ed25519"
+	"encoding/hex"
 	"fmt"
+	"math/rand"
 	"net"
 	"os"
+	"strconv"
 
 	"anonymous-messaging/clientCore"
+	"anonymous-messaging/discover"
 	"anonymous-messaging/networker"
+	"anonymous-messaging/pex"
 	"anonymous-messaging/pki"
 	"anonymous-messaging/config"
+	"anonymous-messaging/transport"
 	"github.com/jmoiron/sqlx"
 	"crypto/elliptic"
 	"anonymous-messaging/helpers"
@@ -48,6 +55,58 @@ type Client struct {
 	pkiDir string
 	Provider config.MixPubs
 	Config config.ClientPubs
+
+	AddrBook  *pex.AddrBook
+	Discovery *discover.Service
+}
+
+// GetRandomMixSequence draws pathLength mixes, preferring currently known
+// live nodes from the Kademlia routing table (if discovery is running), then
+// falling back to the address book's reverified ("old" bucket) entries, and
+// finally to the supplied mixes (normally ActiveMixes loaded from the legacy
+// PKI) when neither has enough entries yet. It deliberately uses
+// VerifiedSample rather than Sample: a bare gossiped PEX_RESPONSE record must
+// not be sampleable as a real mix hop before the reactor's reverifyLoop has
+// had a chance to probe it.
+func (c *Client) GetRandomMixSequence(mixes []config.MixPubs, pathLength int) []config.MixPubs {
+	if c.Discovery != nil {
+		if sequence := c.mixSequenceFromDiscovery(pathLength); sequence != nil {
+			return sequence
+		}
+	}
+
+	if c.AddrBook == nil {
+		return c.CryptoClient.GetRandomMixSequence(mixes, pathLength)
+	}
+
+	sample := c.AddrBook.VerifiedSample(pathLength)
+	if len(sample) < pathLength {
+		return c.CryptoClient.GetRandomMixSequence(mixes, pathLength)
+	}
+
+	sequence := make([]config.MixPubs, len(sample))
+	for i, rec := range sample {
+		sequence[i] = config.MixPubs{Id: rec.Id, Host: rec.Host, Port: rec.Port, PubKey: rec.PubKey}
+	}
+	return sequence
+}
+
+// mixSequenceFromDiscovery samples pathLength nodes uniformly at random from
+// the Kademlia routing table's currently known live nodes. It returns nil if
+// the table does not yet hold enough nodes.
+func (c *Client) mixSequenceFromDiscovery(pathLength int) []config.MixPubs {
+	live := c.Discovery.RoutingTable().AllNodes()
+	if len(live) < pathLength {
+		return nil
+	}
+
+	rand.Shuffle(len(live), func(i, j int) { live[i], live[j] = live[j], live[i] })
+
+	sequence := make([]config.MixPubs, pathLength)
+	for i := 0; i < pathLength; i++ {
+		sequence[i] = config.MixPubs{Id: hex.EncodeToString(live[i].ID[:]), Host: live[i].IP.String(), Port: fmt.Sprintf("%d", live[i].TCPPort), PubKey: live[i].PubKey}
+	}
+	return sequence
 }
 
 func (c *Client) SendMessage(message string, recipient config.ClientPubs) {
@@ -75,7 +134,7 @@ func (c *Client) SendMessage(message string, recipient config.ClientPubs) {
 
 func (c *Client) Send(packet []byte, host string, port string) error {
 
-	conn, err := net.Dial("tcp", host+":"+port)
+	conn, err := transport.Dial(host+":"+port, ed25519.PublicKey(c.PubKey), ed25519.PrivateKey(c.PrvKey), c.expectedPubFor(host, port))
 
 	if err != nil {
 		fmt.Print("Error in Client connect: ", err.Error())
@@ -88,6 +147,30 @@ func (c *Client) Send(packet []byte, host string, port string) error {
 	return err
 }
 
+// expectedPubFor recovers the PKI-known public key for host:port, the
+// destination Send is about to dial, so the transport handshake can pin
+// against it instead of trusting whatever key the remote end presents. It
+// checks the client's own provider and known-clients PKI records first, then
+// falls back to the PEX address book, and returns nil - accept-anyone - only
+// when none of those sources know the address yet.
+func (c *Client) expectedPubFor(host, port string) ed25519.PublicKey {
+	address := host + ":" + port
+	if c.Provider.Host+":"+c.Provider.Port == address {
+		return ed25519.PublicKey(c.Provider.PubKey)
+	}
+	for _, other := range c.OtherClients {
+		if other.Host+":"+other.Port == address {
+			return ed25519.PublicKey(other.PubKey)
+		}
+	}
+	if c.AddrBook != nil {
+		if rec, ok := c.AddrBook.FindByAddress(address); ok {
+			return ed25519.PublicKey(rec.PubKey)
+		}
+	}
+	return nil
+}
+
 func (c *Client) ListenForIncomingConnections() {
 	for {
 		conn, err := c.listener.Accept()
@@ -103,15 +186,22 @@ func (c *Client) ListenForIncomingConnections() {
 func (c *Client) HandleConnection(conn net.Conn) {
 	fmt.Println("> Handle Connection")
 
-	buff := make([]byte, 1024)
+	// expectedPeerPub is nil: an inbound connection can legitimately come
+	// from any mix in the path, not just the client's own provider, so there
+	// is no single PKI key to pin against before the handshake reveals who is
+	// calling.
+	secureConn, err := transport.Accept(conn, ed25519.PublicKey(c.PubKey), ed25519.PrivateKey(c.PrvKey), nil)
+	if err != nil {
+		panic(err)
+	}
+	defer secureConn.Close()
 
-	reqLen, err := conn.Read(buff)
+	packet, err := secureConn.ReadFrame()
 	if err != nil {
 		panic(err)
 	}
 
-	c.ProcessPacket(buff[:reqLen])
-	conn.Close()
+	c.ProcessPacket(packet)
 }
 
 func (c *Client) ProcessPacket(packet []byte) []byte {
@@ -136,6 +226,9 @@ func (c *Client) Run() {
 	fmt.Println("> Client is running")
 
 	defer c.listener.Close()
+	if c.Discovery != nil {
+		defer c.Discovery.Stop()
+	}
 	finish := make(chan bool)
 
 	go func() {
@@ -249,7 +342,12 @@ func SaveInPKI(c Client, pkiDir string) {
 	db.Close()
 }
 
-func NewClient(id, host, port string, pubKey []byte, prvKey []byte, pkiDir string, provider config.MixPubs) *Client {
+// NewClient constructs a new client. When udpPort is non-empty, the client
+// also joins the Kademlia discovery DHT on host:udpPort and seeds its
+// routing table from seeds (normally a handful of well-known bootnodes), so
+// GetRandomMixSequence can draw live mixes from discovery instead of always
+// falling back to the legacy PKI; pass "" and nil to leave discovery off.
+func NewClient(id, host, port string, pubKey []byte, prvKey []byte, pkiDir string, provider config.MixPubs, udpPort string, seeds []discover.Node) *Client {
 	core := clientCore.CryptoClient{Id: id, PubKey: pubKey, PrvKey: prvKey, Curve: elliptic.P224()}
 
 	c := Client{Host: host, Port: port, CryptoClient: core, Provider: provider, pkiDir: pkiDir}
@@ -267,5 +365,38 @@ func NewClient(id, host, port string, pubKey []byte, prvKey []byte, pkiDir strin
 	if err != nil {
 		panic(err)
 	}
+
+	addrBook, err := pex.NewAddrBook(fmt.Sprintf("./addrbooks/%s.json", id))
+	if err != nil {
+		panic(err)
+	}
+	c.AddrBook = addrBook
+
+	if udpPort != "" {
+		tcpPort, err := strconv.Atoi(port)
+		if err != nil {
+			panic(err)
+		}
+		udpPortNum, err := strconv.Atoi(udpPort)
+		if err != nil {
+			panic(err)
+		}
+		self := discover.Node{
+			ID:      discover.IdFromPubKey(pubKey),
+			IP:      net.ParseIP(host),
+			UDPPort: udpPortNum,
+			TCPPort: tcpPort,
+			PubKey:  pubKey,
+		}
+		service, err := discover.Listen(self, host+":"+udpPort)
+		if err != nil {
+			panic(err)
+		}
+		service.Start()
+		if len(seeds) > 0 {
+			service.Bootstrap(seeds)
+		}
+		c.Discovery = service
+	}
 	return &c
 }
@@ -0,0 +1,58 @@
+/*
+	Command bootnode runs only the Kademlia discovery loop, without acting as
+	a mix or provider, so it can serve as a stable bootstrap entry point for
+	other nodes joining the network.
+*/
+package main
+
+import (
+	"crypto/ed25519"
+	"flag"
+	"net"
+
+	"anonymous-messaging/discover"
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	listenAddr := flag.String("addr", ":30301", "UDP address to listen for discovery traffic on")
+	flag.Parse()
+
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		log.Fatal("bootnode: failed to generate identity key: ", err)
+	}
+
+	host, portStr, err := net.SplitHostPort(*listenAddr)
+	if err != nil {
+		log.Fatal("bootnode: invalid -addr: ", err)
+	}
+	if host == "" {
+		host = "0.0.0.0"
+	}
+
+	self := discover.Node{
+		ID:      discover.IdFromPubKey(pub),
+		IP:      net.ParseIP(host),
+		UDPPort: mustAtoi(portStr),
+		PubKey:  pub,
+	}
+
+	service, err := discover.Listen(self, *listenAddr)
+	if err != nil {
+		log.Fatal("bootnode: failed to start discovery listener: ", err)
+	}
+
+	service.Start()
+	log.WithFields(log.Fields{"addr": *listenAddr}).Info("bootnode: discovery loop running")
+
+	select {}
+}
+
+func mustAtoi(s string) int {
+	n := 0
+	for _, c := range s {
+		n = n*10 + int(c-'0')
+	}
+	return n
+}
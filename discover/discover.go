@@ -0,0 +1,395 @@
+package discover
+
+import (
+	"encoding/hex"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// alpha is the lookup concurrency parameter: a lookup round queries the
+	// alpha closest not-yet-queried nodes in parallel.
+	alpha = 3
+
+	pingTimeout      = 2 * time.Second
+	findNodeTimeout  = 2 * time.Second
+	refreshPeriod    = 5 * time.Minute
+	maxPacketLength  = 4096
+)
+
+// Service runs the UDP discovery loop for a single local node: it answers
+// PING/FINDNODE from peers, drives recursive FINDNODE lookups on behalf of
+// the caller, and periodically refreshes stale buckets.
+type Service struct {
+	self Node
+	rt   *RoutingTable
+	conn *net.UDPConn
+
+	mu      sync.Mutex
+	waiters map[string]chan packet
+
+	quit chan struct{}
+}
+
+// Listen opens a UDP socket on laddr and returns a Service ready to be
+// Start-ed.
+func Listen(self Node, laddr string) (*Service, error) {
+	addr, err := net.ResolveUDPAddr("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Service{
+		self:    self,
+		rt:      NewRoutingTable(self.ID),
+		conn:    conn,
+		waiters: make(map[string]chan packet),
+		quit:    make(chan struct{}),
+	}, nil
+}
+
+// Start launches the read loop and the periodic bucket-refresh sweep.
+func (s *Service) Start() {
+	go s.readLoop()
+	go s.refreshLoop()
+}
+
+// Stop closes the UDP socket and terminates the background goroutines.
+func (s *Service) Stop() {
+	close(s.quit)
+	s.conn.Close()
+}
+
+// RoutingTable exposes the service's table, mainly so callers like
+// Client.GetRandomMixSequence can sample currently known live nodes.
+func (s *Service) RoutingTable() *RoutingTable {
+	return s.rt
+}
+
+// Bootstrap seeds the routing table from a fixed list of bootnodes and
+// performs a self-lookup to populate the table from their answers.
+func (s *Service) Bootstrap(seeds []Node) {
+	for _, seed := range seeds {
+		s.rt.Add(seed)
+	}
+	s.Lookup(s.self.ID)
+}
+
+func (s *Service) readLoop() {
+	buf := make([]byte, maxPacketLength)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.quit:
+				return
+			default:
+				log.WithFields(log.Fields{"id": hex.EncodeToString(s.self.ID[:])}).Warning("discover: read error: ", err)
+				continue
+			}
+		}
+
+		p, err := decodePacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		go s.dispatch(p, addr)
+	}
+}
+
+func (s *Service) dispatch(p packet, addr *net.UDPAddr) {
+	if sender, ok := verifiedSender(p.Sender, addr); ok {
+		sender.LastPong = time.Now()
+		if full, evictionCandidate := s.rt.Add(sender); full {
+			s.probeForEviction(evictionCandidate, sender)
+		}
+	}
+
+	switch p.Type {
+	case rpcPing:
+		s.reply(addr, packet{Type: rpcPong, Token: p.Token, Sender: toWire(s.self)})
+	case rpcFindNode:
+		s.handleFindNode(p, addr)
+	case rpcPong, rpcNeighbors:
+		s.deliver(p)
+	}
+}
+
+// verifiedSender decodes a packet's self-reported Sender and admits it only
+// if its claims are consistent with facts the network itself provides:
+// fromWire already rejects an ID that isn't sha256(claimed pubkey), and here
+// the claimed IP/UDP port must additionally match addr, the UDP packet's
+// real source. Without the latter check, any node could gossip itself under
+// someone else's IP and have it admitted straight into the routing table
+// that GetRandomMixSequence samples mix paths from.
+func verifiedSender(w wireNode, addr *net.UDPAddr) (Node, bool) {
+	n, ok := fromWire(w)
+	if !ok {
+		return Node{}, false
+	}
+	if !n.IP.Equal(addr.IP) || n.UDPPort != addr.Port {
+		return Node{}, false
+	}
+	return n, true
+}
+
+func (s *Service) handleFindNode(p packet, addr *net.UDPAddr) {
+	targetBytes, err := hex.DecodeString(p.Target)
+	if err != nil || len(targetBytes) != idLength {
+		return
+	}
+	var target ID
+	copy(target[:], targetBytes)
+
+	closest := s.rt.Closest(target, bucketSize)
+	wireNodes := make([]wireNode, len(closest))
+	for i, n := range closest {
+		wireNodes[i] = toWire(n)
+	}
+
+	s.reply(addr, packet{Type: rpcNeighbors, Token: p.Token, Nodes: wireNodes, Sender: toWire(s.self)})
+}
+
+func (s *Service) reply(addr *net.UDPAddr, p packet) {
+	data, err := encodePacket(p)
+	if err != nil {
+		return
+	}
+	s.conn.WriteToUDP(data, addr)
+}
+
+func (s *Service) deliver(p packet) {
+	s.mu.Lock()
+	ch, ok := s.waiters[p.Token]
+	s.mu.Unlock()
+	if ok {
+		select {
+		case ch <- p:
+		default:
+		}
+	}
+}
+
+func (s *Service) awaitToken(token string) chan packet {
+	ch := make(chan packet, 1)
+	s.mu.Lock()
+	s.waiters[token] = ch
+	s.mu.Unlock()
+	return ch
+}
+
+func (s *Service) forgetToken(token string) {
+	s.mu.Lock()
+	delete(s.waiters, token)
+	s.mu.Unlock()
+}
+
+// Ping sends a liveness PING to n and reports whether it answered with a
+// matching PONG before pingTimeout.
+func (s *Service) Ping(n Node) bool {
+	token := randomToken()
+	ch := s.awaitToken(token)
+	defer s.forgetToken(token)
+
+	data, err := encodePacket(packet{Type: rpcPing, Token: token, Sender: toWire(s.self)})
+	if err != nil {
+		return false
+	}
+	if _, err := s.conn.WriteToUDP(data, n.udpAddr()); err != nil {
+		return false
+	}
+
+	select {
+	case <-ch:
+		return true
+	case <-time.After(pingTimeout):
+		return false
+	}
+}
+
+// verifyAndAdd admits n to the routing table only once the address it
+// claims has actually answered a direct PING, so a node named in someone
+// else's NEIGHBORS reply can never ride straight into the table on that
+// claim alone - it must independently prove it controls the address.
+func (s *Service) verifyAndAdd(n Node) {
+	if !s.Ping(n) {
+		return
+	}
+	if full, evictionCandidate := s.rt.Add(n); full {
+		s.probeForEviction(evictionCandidate, n)
+	}
+}
+
+func (s *Service) probeForEviction(candidate, replacement Node) {
+	if s.Ping(candidate) {
+		return
+	}
+	s.rt.Replace(candidate.ID, replacement)
+}
+
+// findNode asks n for the nodes closest to target.
+func (s *Service) findNode(n Node, target ID) ([]Node, error) {
+	token := randomToken()
+	ch := s.awaitToken(token)
+	defer s.forgetToken(token)
+
+	data, err := encodePacket(packet{Type: rpcFindNode, Token: token, Target: hex.EncodeToString(target[:]), Sender: toWire(s.self)})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.conn.WriteToUDP(data, n.udpAddr()); err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-ch:
+		var nodes []Node
+		for _, w := range resp.Nodes {
+			if node, ok := fromWire(w); ok {
+				nodes = append(nodes, node)
+			}
+		}
+		return nodes, nil
+	case <-time.After(findNodeTimeout):
+		return nil, nil
+	}
+}
+
+// Lookup performs a recursive FINDNODE lookup for target: each round queries
+// the alpha closest unqueried known nodes in parallel, merging their replies
+// into the candidate set, and terminates once a full round yields no node
+// closer than what was already known.
+func (s *Service) Lookup(target ID) []Node {
+	queried := make(map[ID]bool)
+	var mu sync.Mutex
+
+	candidates := s.rt.Closest(target, bucketSize)
+
+	for {
+		sort.Slice(candidates, func(i, j int) bool {
+			return target.Xor(candidates[i].ID).Less(target.Xor(candidates[j].ID))
+		})
+
+		var toQuery []Node
+		mu.Lock()
+		for _, n := range candidates {
+			if !queried[n.ID] {
+				toQuery = append(toQuery, n)
+			}
+			if len(toQuery) == alpha {
+				break
+			}
+		}
+		mu.Unlock()
+		if len(toQuery) == 0 {
+			break
+		}
+
+		var wg sync.WaitGroup
+		resultsCh := make(chan []Node, len(toQuery))
+		for _, n := range toQuery {
+			mu.Lock()
+			queried[n.ID] = true
+			mu.Unlock()
+
+			wg.Add(1)
+			go func(n Node) {
+				defer wg.Done()
+				found, err := s.findNode(n, target)
+				if err != nil {
+					return
+				}
+				resultsCh <- found
+			}(n)
+		}
+		wg.Wait()
+		close(resultsCh)
+
+		closestBefore := closestDistance(candidates, target)
+		for found := range resultsCh {
+			for _, n := range found {
+				// found entries are whatever the queried peer claims about
+				// nodes it doesn't own; fromWire already rejected an
+				// inconsistent ID/pubkey, but the IP/port could still be a
+				// lie, turning a blind rt.Add here into a UDP reflection
+				// primitive as well as route poisoning. They're usable as
+				// lookup candidates immediately, but only verifyAndAdd's
+				// direct Ping to the claimed address earns a place in the
+				// routing table Lookup/GetRandomMixSequence actually trust.
+				candidates = mergeClosest(candidates, n, target, bucketSize)
+				go s.verifyAndAdd(n)
+			}
+		}
+
+		if !closestDistance(candidates, target).Less(closestBefore) {
+			break
+		}
+	}
+
+	return candidates
+}
+
+func closestDistance(nodes []Node, target ID) ID {
+	best := ID{}
+	for i := range best {
+		best[i] = 0xFF
+	}
+	for _, n := range nodes {
+		d := target.Xor(n.ID)
+		if d.Less(best) {
+			best = d
+		}
+	}
+	return best
+}
+
+func mergeClosest(candidates []Node, n Node, target ID, limit int) []Node {
+	for _, existing := range candidates {
+		if existing.ID == n.ID {
+			return candidates
+		}
+	}
+	candidates = append(candidates, n)
+	if len(candidates) <= limit {
+		return candidates
+	}
+
+	worstIdx, worstDist := 0, target.Xor(candidates[0].ID)
+	for i, c := range candidates {
+		d := target.Xor(c.ID)
+		if worstDist.Less(d) {
+			worstIdx, worstDist = i, d
+		}
+	}
+	return append(candidates[:worstIdx], candidates[worstIdx+1:]...)
+}
+
+// refreshLoop periodically pings the least-recently-seen entry of a bucket,
+// evicting it if it no longer answers.
+func (s *Service) refreshLoop() {
+	ticker := time.NewTicker(refreshPeriod)
+	defer ticker.Stop()
+
+	bucketIdx := 0
+	for {
+		select {
+		case <-ticker.C:
+			if n, ok := s.rt.LeastRecentlySeenBucket(bucketIdx); ok {
+				if !s.Ping(n) {
+					s.rt.Evict(n.ID)
+				}
+			}
+			bucketIdx = (bucketIdx + 1) % bucketCount
+		case <-s.quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,78 @@
+/*
+	Package discover implements a Kademlia-like DHT over UDP so that clients
+	and providers can find mix nodes by id without preloading the full mix
+	set from the shared SQLite PKI.
+*/
+package discover
+
+import (
+	"crypto/sha256"
+	"net"
+	"time"
+)
+
+// idLength is 256 bits, matching a SHA-256 digest of a node's public key.
+const idLength = 32
+
+// ID is a node's 256-bit Kademlia identifier.
+type ID [idLength]byte
+
+// IdFromPubKey derives a node's Kademlia ID by hashing its long-term public
+// key, so ids cannot be chosen freely by an attacker wanting to land close to
+// a specific target.
+func IdFromPubKey(pubKey []byte) ID {
+	return ID(sha256.Sum256(pubKey))
+}
+
+// Xor returns the bitwise XOR distance between two ids.
+func (a ID) Xor(b ID) ID {
+	var d ID
+	for i := range a {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+// Less reports whether a is closer to nothing in particular, but is ordered
+// consistently so two distances can be compared: it treats the id as a big
+// 256-bit integer.
+func (a ID) Less(b ID) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// bucketIndex returns which of the 256 k-buckets a distance falls into: the
+// bucket index equals the position (counting from the most significant bit)
+// of the highest set bit in the distance, so closer nodes land in
+// higher-numbered buckets.
+func bucketIndex(distance ID) int {
+	for byteIdx, b := range distance {
+		if b == 0 {
+			continue
+		}
+		for bit := 0; bit < 8; bit++ {
+			if b&(0x80>>uint(bit)) != 0 {
+				return byteIdx*8 + bit
+			}
+		}
+	}
+	return idLength*8 - 1
+}
+
+// Node is everything the routing table needs to know about a peer.
+type Node struct {
+	ID       ID
+	IP       net.IP
+	UDPPort  int
+	TCPPort  int
+	PubKey   []byte
+	LastPong time.Time
+}
+
+func (n Node) udpAddr() *net.UDPAddr {
+	return &net.UDPAddr{IP: n.IP, Port: n.UDPPort}
+}
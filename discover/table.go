@@ -0,0 +1,146 @@
+package discover
+
+import (
+	"sort"
+	"sync"
+)
+
+const (
+	bucketCount = idLength * 8 // 256
+	bucketSize  = 16           // k
+)
+
+// bucket holds up to bucketSize nodes, ordered least-recently-seen first so
+// the refresh loop always knows which entry to ping next.
+type bucket struct {
+	mu      sync.Mutex
+	entries []Node
+}
+
+func (b *bucket) upsert(n Node) (evicted bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i, existing := range b.entries {
+		if existing.ID == n.ID {
+			// Move the refreshed entry to the back (most-recently-seen).
+			b.entries = append(append(b.entries[:i], b.entries[i+1:]...), n)
+			return false
+		}
+	}
+
+	if len(b.entries) < bucketSize {
+		b.entries = append(b.entries, n)
+		return false
+	}
+	return true
+}
+
+func (b *bucket) leastRecentlySeen() (Node, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.entries) == 0 {
+		return Node{}, false
+	}
+	return b.entries[0], true
+}
+
+func (b *bucket) evict(id ID) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, existing := range b.entries {
+		if existing.ID == id {
+			b.entries = append(b.entries[:i], b.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+func (b *bucket) snapshot() []Node {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make([]Node, len(b.entries))
+	copy(out, b.entries)
+	return out
+}
+
+// RoutingTable is the full set of 256 k-buckets for a single local node.
+type RoutingTable struct {
+	self    ID
+	buckets [bucketCount]*bucket
+}
+
+// NewRoutingTable constructs an empty routing table for the node identified
+// by self.
+func NewRoutingTable(self ID) *RoutingTable {
+	rt := &RoutingTable{self: self}
+	for i := range rt.buckets {
+		rt.buckets[i] = &bucket{}
+	}
+	return rt
+}
+
+func (rt *RoutingTable) bucketFor(id ID) *bucket {
+	return rt.buckets[bucketIndex(rt.self.Xor(id))]
+}
+
+// Add inserts or refreshes n in its bucket. If the bucket is already full,
+// Add reports the bucket's least-recently-seen entry so the caller can probe
+// it with Ping before deciding whether to evict it in favor of n.
+func (rt *RoutingTable) Add(n Node) (full bool, evictionCandidate Node) {
+	if n.ID == rt.self {
+		return false, Node{}
+	}
+	b := rt.bucketFor(n.ID)
+	if evicted := b.upsert(n); evicted {
+		candidate, _ := b.leastRecentlySeen()
+		return true, candidate
+	}
+	return false, Node{}
+}
+
+// Replace evicts oldID from its bucket and inserts replacement in its place.
+func (rt *RoutingTable) Replace(oldID ID, replacement Node) {
+	rt.bucketFor(oldID).evict(oldID)
+	rt.bucketFor(replacement.ID).upsert(replacement)
+}
+
+// Evict removes id from the table, e.g. after it fails to answer a ping.
+func (rt *RoutingTable) Evict(id ID) {
+	rt.bucketFor(id).evict(id)
+}
+
+// Closest returns the count nodes in the table closest to target by XOR
+// distance.
+func (rt *RoutingTable) Closest(target ID, count int) []Node {
+	var all []Node
+	for _, b := range rt.buckets {
+		all = append(all, b.snapshot()...)
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		return target.Xor(all[i].ID).Less(target.Xor(all[j].ID))
+	})
+
+	if count > len(all) {
+		count = len(all)
+	}
+	return all[:count]
+}
+
+// AllNodes returns every node currently held across all buckets, for callers
+// that want to sample uniformly rather than by proximity to some target.
+func (rt *RoutingTable) AllNodes() []Node {
+	var all []Node
+	for _, b := range rt.buckets {
+		all = append(all, b.snapshot()...)
+	}
+	return all
+}
+
+// LeastRecentlySeenBucket returns the least-recently-seen entry of bucket
+// bucketIdx (taken modulo bucketCount), or false if that bucket is empty. The
+// periodic refresh sweep calls it with each bucket index in turn.
+func (rt *RoutingTable) LeastRecentlySeenBucket(bucketIdx int) (Node, bool) {
+	return rt.buckets[bucketIdx%bucketCount].leastRecentlySeen()
+}
@@ -0,0 +1,61 @@
+/*
+	Package frame implements simple length-prefixed message framing over a
+	net.Conn, so that a single TCP read can no longer truncate a Sphinx
+	packet or protobuf message: every frame is written and read as
+	[uint32 big-endian length | payload], with the read side always looping
+	via io.ReadFull until either the full frame arrives or the connection
+	errors out.
+*/
+package frame
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+// MaxFrameLength is the largest payload frame.Read will accept. A peer
+// advertising a longer frame is treated as misbehaving and the read fails
+// rather than allocating an unbounded buffer.
+const MaxFrameLength = 1 << 20 // 1 MiB
+
+// ErrFrameTooLarge is returned by Read when the advertised frame length
+// exceeds MaxFrameLength.
+var ErrFrameTooLarge = errors.New("frame: advertised frame length exceeds MaxFrameLength")
+
+// Write sends payload over conn as a single length-prefixed frame.
+func Write(conn net.Conn, payload []byte) error {
+	if len(payload) > MaxFrameLength {
+		return ErrFrameTooLarge
+	}
+
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(payload)))
+
+	if _, err := conn.Write(header); err != nil {
+		return err
+	}
+	_, err := conn.Write(payload)
+	return err
+}
+
+// Read receives the next length-prefixed frame from conn, blocking with
+// io.ReadFull until the whole frame has arrived or the connection fails.
+func Read(conn net.Conn) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header)
+	if length > MaxFrameLength {
+		return nil, ErrFrameTooLarge
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
@@ -0,0 +1,92 @@
+package frame
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestReadHandlesPartialWrites checks that Read reassembles a frame written
+// in two parts (the length header, then a 60000-byte payload), which is well
+// over what the old `buff := make([]byte, 1024); conn.Read(buff)` pattern
+// could read. TestReadAcrossTrickledWrites covers a writer that sends a few
+// bytes at a time.
+func TestReadHandlesPartialWrites(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	payload := bytes.Repeat([]byte("loopix"), 10000) // well over 1024 bytes
+
+	go func() {
+		if err := Write(client, payload); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	readPayload, err := Read(server)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if !bytes.Equal(readPayload, payload) {
+		t.Fatalf("frame payload corrupted: expected %d bytes, got %d", len(payload), len(readPayload))
+	}
+}
+
+// trickleConn wraps a net.Conn so every Write is split into small chunks
+// with a short pause between them, simulating a connection that delivers a
+// frame over many partial reads.
+type trickleConn struct {
+	net.Conn
+}
+
+func (t trickleConn) Write(b []byte) (int, error) {
+	for i := 0; i < len(b); i += 7 {
+		end := i + 7
+		if end > len(b) {
+			end = len(b)
+		}
+		if _, err := t.Conn.Write(b[i:end]); err != nil {
+			return i, err
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return len(b), nil
+}
+
+func TestReadAcrossTrickledWrites(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	payload := []byte("a Sphinx packet that arrives in dribs and drabs")
+
+	go Write(trickleConn{client}, payload)
+
+	readPayload, err := Read(server)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if !bytes.Equal(readPayload, payload) {
+		t.Fatalf("expected %q, got %q", payload, readPayload)
+	}
+}
+
+func TestReadRejectsOversizedFrame(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		header := []byte{0xFF, 0xFF, 0xFF, 0xFF} // advertises ~4 GiB
+		client.Write(header)
+	}()
+
+	if _, err := Read(server); err != ErrFrameTooLarge {
+		t.Fatalf("expected ErrFrameTooLarge, got %v", err)
+	}
+}
+
+var _ io.Writer = trickleConn{}
@@ -0,0 +1,204 @@
+/*
+	Package fuzz provides FuzzedConn, a net.Conn wrapper that injects network
+	imperfections - dropped bytes, delayed reads/writes, and buffered
+	hold-then-flush writes - driven by a seeded RNG so test runs are
+	reproducible. It exists so higher layers (frame, server, client) can be
+	exercised against partial reads, delayed writes and batched sends without
+	needing a real flaky network. No mode reorders bytes.
+*/
+package fuzz
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Mode selects which kind of imperfection FuzzedConn injects.
+type Mode int
+
+const (
+	// ModeDropBytes randomly discards a fraction of the bytes passing
+	// through Read and Write, simulating corruption/loss at the application
+	// layer.
+	ModeDropBytes Mode = iota
+	// ModeDelay injects a random time.Sleep before each Read/Write.
+	ModeDelay
+	// ModeHoldThenFlush buffers writes and only forwards them to the
+	// underlying connection once a randomly chosen flush point is reached,
+	// simulating a peer that batches or stalls its sends.
+	ModeHoldThenFlush
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeDropBytes:
+		return "drop-bytes"
+	case ModeDelay:
+		return "delay"
+	case ModeHoldThenFlush:
+		return "hold-then-flush"
+	default:
+		return "unknown"
+	}
+}
+
+// FuzzConnConfig configures a FuzzedConn's fault injection.
+type FuzzConnConfig struct {
+	Mode       Mode
+	ProbDropRW float64 // [0,1] probability a given byte is dropped, in ModeDropBytes
+	ProbSleep  float64 // [0,1] probability a delay is injected, in ModeDelay
+	MaxDelayMs int     // upper bound on injected delays
+	Seed       int64   // seeds the RNG so a run is reproducible
+}
+
+// FuzzedConn wraps a net.Conn and applies FuzzConnConfig's imperfection to
+// every Read and Write.
+type FuzzedConn struct {
+	net.Conn
+	cfg FuzzConnConfig
+
+	mu         sync.Mutex
+	rng        *rand.Rand
+	heldWrites []byte
+}
+
+// New wraps conn with the fault injection described by cfg.
+func New(conn net.Conn, cfg FuzzConnConfig) *FuzzedConn {
+	return &FuzzedConn{
+		Conn: conn,
+		cfg:  cfg,
+		rng:  rand.New(rand.NewSource(cfg.Seed)),
+	}
+}
+
+func (f *FuzzedConn) maybeDelay() {
+	if f.cfg.Mode != ModeDelay || f.cfg.MaxDelayMs <= 0 {
+		return
+	}
+
+	f.mu.Lock()
+	roll := f.rng.Float64()
+	var delay time.Duration
+	if roll < f.cfg.ProbSleep {
+		delay = time.Duration(f.rng.Intn(f.cfg.MaxDelayMs)) * time.Millisecond
+	}
+	f.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// Read passes through to the underlying connection, then (in ModeDropBytes)
+// randomly drops some of the bytes that were actually received, compacting
+// the rest to the front of b.
+func (f *FuzzedConn) Read(b []byte) (int, error) {
+	f.maybeDelay()
+
+	n, err := f.Conn.Read(b)
+	if err != nil {
+		return n, err
+	}
+	if f.cfg.Mode == ModeDropBytes {
+		n = f.dropInPlace(b, n)
+	}
+	return n, nil
+}
+
+func (f *FuzzedConn) dropInPlace(b []byte, n int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	kept := 0
+	for i := 0; i < n; i++ {
+		if f.rng.Float64() < f.cfg.ProbDropRW {
+			continue
+		}
+		b[kept] = b[i]
+		kept++
+	}
+	return kept
+}
+
+// Write applies the configured fault injection before forwarding bytes to
+// the underlying connection. It always reports len(b) written, matching
+// net.Conn's contract that Write either sends everything or returns an
+// error - any bytes "lost" here are lost the way a real flaky link would
+// lose them, not as a short write the caller is expected to retry.
+func (f *FuzzedConn) Write(b []byte) (int, error) {
+	f.maybeDelay()
+
+	switch f.cfg.Mode {
+	case ModeDropBytes:
+		return f.writeDropped(b)
+	case ModeHoldThenFlush:
+		return f.writeHeld(b)
+	default:
+		return f.Conn.Write(b)
+	}
+}
+
+func (f *FuzzedConn) writeDropped(b []byte) (int, error) {
+	f.mu.Lock()
+	kept := make([]byte, 0, len(b))
+	for _, c := range b {
+		if f.rng.Float64() < f.cfg.ProbDropRW {
+			continue
+		}
+		kept = append(kept, c)
+	}
+	f.mu.Unlock()
+
+	if len(kept) > 0 {
+		if _, err := f.Conn.Write(kept); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// holdFlushProbability is the chance, per Write call in ModeHoldThenFlush,
+// that the held buffer is flushed to the wire.
+const holdFlushProbability = 0.3
+
+func (f *FuzzedConn) writeHeld(b []byte) (int, error) {
+	f.mu.Lock()
+	f.heldWrites = append(f.heldWrites, b...)
+	var toFlush []byte
+	if f.rng.Float64() < holdFlushProbability {
+		toFlush = f.heldWrites
+		f.heldWrites = nil
+	}
+	f.mu.Unlock()
+
+	if toFlush != nil {
+		if _, err := f.Conn.Write(toFlush); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush forces any bytes buffered by ModeHoldThenFlush out to the underlying
+// connection. It is a no-op in other modes.
+func (f *FuzzedConn) Flush() error {
+	f.mu.Lock()
+	toFlush := f.heldWrites
+	f.heldWrites = nil
+	f.mu.Unlock()
+
+	if len(toFlush) == 0 {
+		return nil
+	}
+	_, err := f.Conn.Write(toFlush)
+	return err
+}
+
+// Close flushes any buffered writes before closing the underlying
+// connection, so a held batch is not silently lost.
+func (f *FuzzedConn) Close() error {
+	f.Flush()
+	return f.Conn.Close()
+}
@@ -0,0 +1,52 @@
+package fuzz
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestHoldThenFlushDeliversEverythingOnClose(t *testing.T) {
+	client, server := net.Pipe()
+	fuzzed := New(client, FuzzConnConfig{Mode: ModeHoldThenFlush, Seed: 42})
+
+	message := []byte("hold then flush should not lose bytes")
+	done := make(chan error, 1)
+	go func() {
+		_, err := fuzzed.Write(message)
+		done <- err
+		fuzzed.Close()
+	}()
+
+	received := make([]byte, len(message))
+	if _, err := io.ReadFull(server, received); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if !bytes.Equal(received, message) {
+		t.Fatalf("expected %q, got %q", message, received)
+	}
+}
+
+func TestDropBytesNeverReturnsMoreThanWasRead(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	fuzzed := New(server, FuzzConnConfig{Mode: ModeDropBytes, ProbDropRW: 0.5, Seed: 7})
+
+	message := bytes.Repeat([]byte("x"), 256)
+	go client.Write(message)
+
+	buf := make([]byte, len(message))
+	n, err := fuzzed.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if n > len(message) {
+		t.Fatalf("read more bytes (%d) than were sent (%d)", n, len(message))
+	}
+}
@@ -0,0 +1,36 @@
+/*
+	Package nat lets a ProviderServer sitting behind a home NAT publish a
+	reachable external address into the PKI. It probes for a gateway using
+	NAT-PMP or UPnP (IGDv1/IGDv2), requests a port mapping, and discovers the
+	gateway's external IP so it can be announced instead of the provider's
+	local bind address.
+*/
+package nat
+
+import "time"
+
+// Interface is a NAT gateway capable of reporting the router's external IP
+// and creating/removing port forwards on it.
+type Interface interface {
+	ExternalIP() (string, error)
+	AddMapping(protocol string, extPort, intPort int, description string, lifetime time.Duration) error
+	DeleteMapping(protocol string, extPort int) error
+}
+
+// discoveryTimeout bounds how long Discover waits for a gateway to answer
+// before giving up and letting the caller fall back to the configured host.
+const discoveryTimeout = 3 * time.Second
+
+// Discover probes the local network for a NAT gateway, trying NAT-PMP first
+// since it is a single UDP round trip, then falling back to UPnP/SSDP. It
+// returns nil, nil (not an error) if no gateway could be found, so callers
+// can fall back gracefully to the user-provided host.
+func Discover() (Interface, error) {
+	if gw, err := discoverNATPMP(discoveryTimeout); err == nil {
+		return gw, nil
+	}
+	if gw, err := discoverUPnP(discoveryTimeout); err == nil {
+		return gw, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,126 @@
+package nat
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const natPMPPort = "5351"
+
+type natPMP struct {
+	gatewayIP net.IP
+}
+
+func discoverNATPMP(timeout time.Duration) (Interface, error) {
+	gw, err := defaultGatewayIP()
+	if err != nil {
+		return nil, err
+	}
+
+	pmp := &natPMP{gatewayIP: gw}
+	if _, err := pmp.ExternalIP(); err != nil {
+		return nil, err
+	}
+	return pmp, nil
+}
+
+func (n *natPMP) roundTrip(opcode byte, payload []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", net.JoinHostPort(n.gatewayIP.String(), natPMPPort), 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	msg := append([]byte{0, opcode}, payload...)
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	resp := make([]byte, 16)
+	respLen, err := conn.Read(resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp[:respLen], nil
+}
+
+// ExternalIP issues a NAT-PMP public address request (opcode 0).
+func (n *natPMP) ExternalIP() (string, error) {
+	resp, err := n.roundTrip(0, nil)
+	if err != nil {
+		return "", err
+	}
+	if len(resp) < 12 {
+		return "", errors.New("nat: malformed NAT-PMP address response")
+	}
+	return net.IPv4(resp[8], resp[9], resp[10], resp[11]).String(), nil
+}
+
+// AddMapping issues a NAT-PMP port mapping request (opcode 1 for UDP, 2 for
+// TCP).
+func (n *natPMP) AddMapping(protocol string, extPort, intPort int, description string, lifetime time.Duration) error {
+	opcode := byte(1)
+	if strings.ToLower(protocol) == "tcp" {
+		opcode = 2
+	}
+
+	payload := make([]byte, 10)
+	binary.BigEndian.PutUint16(payload[2:4], uint16(intPort))
+	binary.BigEndian.PutUint16(payload[4:6], uint16(extPort))
+	binary.BigEndian.PutUint32(payload[6:10], uint32(lifetime.Seconds()))
+
+	resp, err := n.roundTrip(opcode, payload)
+	if err != nil {
+		return err
+	}
+	if len(resp) < 4 {
+		return errors.New("nat: malformed NAT-PMP mapping response")
+	}
+	if resultCode := binary.BigEndian.Uint16(resp[2:4]); resultCode != 0 {
+		return fmt.Errorf("nat: NAT-PMP mapping request failed with result code %d", resultCode)
+	}
+	return nil
+}
+
+// DeleteMapping releases a previously requested mapping by re-requesting it
+// with a zero lifetime, as specified by RFC 6886.
+func (n *natPMP) DeleteMapping(protocol string, extPort int) error {
+	return n.AddMapping(protocol, extPort, extPort, "", 0)
+}
+
+// defaultGatewayIP reads the kernel routing table to find the default
+// gateway. This only works on Linux, which matches the rest of this project's
+// deployment target.
+func defaultGatewayIP() (net.IP, error) {
+	file, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // header line
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		return hexLittleEndianToIP(fields[2])
+	}
+	return nil, errors.New("nat: no default gateway found in routing table")
+}
+
+func hexLittleEndianToIP(hexAddr string) (net.IP, error) {
+	var raw uint32
+	if _, err := fmt.Sscanf(hexAddr, "%x", &raw); err != nil {
+		return nil, err
+	}
+	return net.IPv4(byte(raw), byte(raw>>8), byte(raw>>16), byte(raw>>24)), nil
+}
@@ -0,0 +1,223 @@
+package nat
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const ssdpAddress = "239.255.255.250:1900"
+
+// upnpDevice is a discovered IGDv1/IGDv2 Internet Gateway Device, addressed
+// by the SOAP control URL of its WANIPConnection (or WANPPPConnection)
+// service.
+type upnpDevice struct {
+	controlURL  string
+	serviceType string
+}
+
+// discoverUPnP finds an Internet Gateway Device via SSDP multicast discovery,
+// fetches its device description and locates the WAN connection service's
+// SOAP control URL.
+func discoverUPnP(timeout time.Duration) (Interface, error) {
+	location, err := ssdpDiscover(timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	controlURL, serviceType, err := fetchControlURL(location)
+	if err != nil {
+		return nil, err
+	}
+
+	return &upnpDevice{controlURL: controlURL, serviceType: serviceType}, nil
+}
+
+func ssdpDiscover(timeout time.Duration) (string, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	addr, err := net.ResolveUDPAddr("udp4", ssdpAddress)
+	if err != nil {
+		return "", err
+	}
+
+	const searchTargets = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+	req := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddress + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n" +
+		"ST: " + searchTargets + "\r\n\r\n"
+
+	if _, err := conn.WriteTo([]byte(req), addr); err != nil {
+		return "", err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 2048)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(string(buf[:n]), "\r\n") {
+		if strings.HasPrefix(strings.ToUpper(line), "LOCATION:") {
+			return strings.TrimSpace(line[len("LOCATION:"):]), nil
+		}
+	}
+	return "", errors.New("nat: SSDP response did not contain a LOCATION header")
+}
+
+// fetchControlURL fetches the device description XML at location and pulls
+// out the control URL for whichever WAN connection service is present. The
+// description format is simple enough that a direct substring scan is
+// sufficient and avoids pulling in an XML dependency for two fields.
+func fetchControlURL(location string) (string, string, error) {
+	resp, err := http.Get(location)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", err
+	}
+
+	for _, serviceType := range []string{
+		"urn:schemas-upnp-org:service:WANIPConnection:1",
+		"urn:schemas-upnp-org:service:WANIPConnection:2",
+		"urn:schemas-upnp-org:service:WANPPPConnection:1",
+	} {
+		if idx := bytes.Index(body, []byte(serviceType)); idx != -1 {
+			rest := body[idx:]
+			ctrlIdx := bytes.Index(rest, []byte("<controlURL>"))
+			if ctrlIdx == -1 {
+				continue
+			}
+			rest = rest[ctrlIdx+len("<controlURL>"):]
+			endIdx := bytes.Index(rest, []byte("</controlURL>"))
+			if endIdx == -1 {
+				continue
+			}
+			path := string(rest[:endIdx])
+			return resolveURL(location, path), serviceType, nil
+		}
+	}
+	return "", "", errors.New("nat: no WAN connection service found in device description")
+}
+
+func resolveURL(base, path string) string {
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		return path
+	}
+	schemeEnd := strings.Index(base, "://") + 3
+	hostEnd := strings.Index(base[schemeEnd:], "/")
+	if hostEnd == -1 {
+		return base + path
+	}
+	return base[:schemeEnd+hostEnd] + path
+}
+
+func (d *upnpDevice) soapCall(action string, args map[string]string) ([]byte, error) {
+	var argsXML strings.Builder
+	for k, v := range args {
+		argsXML.WriteString(fmt.Sprintf("<%s>%s</%s>", k, v, k))
+	}
+
+	body := fmt.Sprintf(`<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body><u:%s xmlns:u="%s">%s</u:%s></s:Body>
+</s:Envelope>`, action, d.serviceType, argsXML.String(), action)
+
+	req, err := http.NewRequest("POST", d.controlURL, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, d.serviceType, action))
+
+	resp, err := (&http.Client{Timeout: 5 * time.Second}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("nat: UPnP SOAP action %s failed: %s", action, string(respBody))
+	}
+	return respBody, nil
+}
+
+func extractTag(xml []byte, tag string) (string, bool) {
+	open := []byte("<" + tag + ">")
+	closeTag := []byte("</" + tag + ">")
+	start := bytes.Index(xml, open)
+	if start == -1 {
+		return "", false
+	}
+	start += len(open)
+	end := bytes.Index(xml[start:], closeTag)
+	if end == -1 {
+		return "", false
+	}
+	return string(xml[start : start+end]), true
+}
+
+func (d *upnpDevice) ExternalIP() (string, error) {
+	resp, err := d.soapCall("GetExternalIPAddress", nil)
+	if err != nil {
+		return "", err
+	}
+	ip, ok := extractTag(resp, "NewExternalIPAddress")
+	if !ok {
+		return "", errors.New("nat: UPnP response missing NewExternalIPAddress")
+	}
+	return ip, nil
+}
+
+func (d *upnpDevice) AddMapping(protocol string, extPort, intPort int, description string, lifetime time.Duration) error {
+	_, err := d.soapCall("AddPortMapping", map[string]string{
+		"NewRemoteHost":             "",
+		"NewExternalPort":           fmt.Sprintf("%d", extPort),
+		"NewProtocol":               strings.ToUpper(protocol),
+		"NewInternalPort":           fmt.Sprintf("%d", intPort),
+		"NewInternalClient":         localIP(),
+		"NewEnabled":                "1",
+		"NewPortMappingDescription": description,
+		"NewLeaseDuration":          fmt.Sprintf("%d", int(lifetime.Seconds())),
+	})
+	return err
+}
+
+func (d *upnpDevice) DeleteMapping(protocol string, extPort int) error {
+	_, err := d.soapCall("DeletePortMapping", map[string]string{
+		"NewRemoteHost":   "",
+		"NewExternalPort": fmt.Sprintf("%d", extPort),
+		"NewProtocol":     strings.ToUpper(protocol),
+	})
+	return err
+}
+
+// localIP returns the outbound local address used to reach the internet,
+// needed by AddPortMapping's NewInternalClient argument.
+func localIP() string {
+	conn, err := net.Dial("udp", "8.8.8.8:80")
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
@@ -0,0 +1,295 @@
+/*
+	Package pex implements a gossip-based peer exchange subsystem that lets
+	mix and provider nodes learn about each other without relying solely on
+	the shared SQLite PKI. Each node keeps an on-disk AddrBook of known peer
+	records, split into "new" (unverified, gossiped) and "old" (verified by a
+	direct probe) buckets, and a Reactor that gossips PEX_REQUEST/PEX_RESPONSE
+	packets to keep the book fresh.
+*/
+package pex
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	newBucketSize = 256
+	oldBucketSize = 256
+
+	// DefaultSampleSize is how many records a PEX_REQUEST asks for.
+	DefaultSampleSize = 30
+)
+
+// Record describes everything the address book knows about one peer.
+type Record struct {
+	Id        string
+	Host      string
+	Port      string
+	PubKey    []byte
+	Source    string
+	LastSeen  time.Time
+	FailCount int
+}
+
+func (r Record) address() string {
+	return r.Host + ":" + r.Port
+}
+
+// AddrBook is a disk-backed store of known mix/provider peers, split into a
+// "new" bucket (gossiped, unverified) and an "old" bucket (probed and known
+// good). It is safe for concurrent use.
+type AddrBook struct {
+	mu   sync.Mutex
+	path string
+
+	newBucket map[string]Record
+	oldBucket map[string]Record
+}
+
+// NewAddrBook loads the address book persisted at path, or creates an empty
+// one if the file does not yet exist.
+func NewAddrBook(path string) (*AddrBook, error) {
+	book := &AddrBook{
+		path:      path,
+		newBucket: make(map[string]Record),
+		oldBucket: make(map[string]Record),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return book, nil
+		}
+		return nil, err
+	}
+
+	var onDisk struct {
+		New map[string]Record
+		Old map[string]Record
+	}
+	if err := json.Unmarshal(data, &onDisk); err != nil {
+		return nil, err
+	}
+	if onDisk.New != nil {
+		book.newBucket = onDisk.New
+	}
+	if onDisk.Old != nil {
+		book.oldBucket = onDisk.Old
+	}
+	return book, nil
+}
+
+// Save persists the address book to disk as JSON.
+func (b *AddrBook) Save() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	onDisk := struct {
+		New map[string]Record
+		Old map[string]Record
+	}{New: b.newBucket, Old: b.oldBucket}
+
+	data, err := json.Marshal(onDisk)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(b.path, data, 0644)
+}
+
+// bucketSlot deterministically maps an address to a slot in a bucket of the
+// given size, so that colliding addresses evict each other instead of
+// growing the bucket without bound.
+func bucketSlot(addr string, size int) int {
+	h := fnv.New32a()
+	h.Write([]byte(addr))
+	return int(h.Sum32()) % size
+}
+
+// AddAddress records a peer learned from source (either another peer's id,
+// or "seed" for bootstrap entries) into the "new" bucket. If the record's
+// bucket slot is already occupied by a different address, the older entry is
+// evicted.
+func (b *AddrBook) AddAddress(rec Record, source string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, known := b.oldBucket[rec.Id]; known {
+		return
+	}
+
+	rec.Source = source
+	if rec.LastSeen.IsZero() {
+		rec.LastSeen = time.Now()
+	}
+
+	slot := bucketSlot(rec.address(), newBucketSize)
+	for id, existing := range b.newBucket {
+		if bucketSlot(existing.address(), newBucketSize) == slot && id != rec.Id {
+			delete(b.newBucket, id)
+			break
+		}
+	}
+	b.newBucket[rec.Id] = rec
+}
+
+// MarkGood promotes a peer from the "new" bucket to the "old" bucket,
+// evicting an existing "old" entry that collides on the same slot.
+func (b *AddrBook) MarkGood(id string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	rec, ok := b.newBucket[id]
+	if !ok {
+		rec, ok = b.oldBucket[id]
+		if !ok {
+			return
+		}
+	}
+	rec.FailCount = 0
+	rec.LastSeen = time.Now()
+
+	slot := bucketSlot(rec.address(), oldBucketSize)
+	for existingId, existing := range b.oldBucket {
+		if bucketSlot(existing.address(), oldBucketSize) == slot && existingId != id {
+			delete(b.oldBucket, existingId)
+			break
+		}
+	}
+
+	b.oldBucket[id] = rec
+	delete(b.newBucket, id)
+}
+
+// MarkFailed increments a peer's failure count and evicts it once it exceeds
+// maxFailures.
+func (b *AddrBook) MarkFailed(id string, maxFailures int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if rec, ok := b.oldBucket[id]; ok {
+		rec.FailCount++
+		if rec.FailCount > maxFailures {
+			delete(b.oldBucket, id)
+		} else {
+			b.oldBucket[id] = rec
+		}
+		return
+	}
+	if rec, ok := b.newBucket[id]; ok {
+		rec.FailCount++
+		if rec.FailCount > maxFailures {
+			delete(b.newBucket, id)
+		} else {
+			b.newBucket[id] = rec
+		}
+	}
+}
+
+// Sample returns up to n records drawn uniformly at random without
+// duplication across the "new" and "old" buckets; "old" (verified) entries
+// are not preferred over "new" ones.
+func (b *AddrBook) Sample(n int) []Record {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	seen := make(map[string]bool)
+	var pool []Record
+	for id, rec := range b.oldBucket {
+		if !seen[id] {
+			seen[id] = true
+			pool = append(pool, rec)
+		}
+	}
+	for id, rec := range b.newBucket {
+		if !seen[id] {
+			seen[id] = true
+			pool = append(pool, rec)
+		}
+	}
+
+	rand.Shuffle(len(pool), func(i, j int) { pool[i], pool[j] = pool[j], pool[i] })
+	if n > len(pool) {
+		n = len(pool)
+	}
+	return pool[:n]
+}
+
+// VerifiedSample returns up to n records drawn only from the "old" bucket -
+// peers reverifyLoop has already probed and confirmed reachable at the
+// address they claim. Unlike Sample, it never returns a record straight off
+// an unauthenticated PEX_RESPONSE, so callers that pick real mix hops (as
+// opposed to ones merely continuing gossip propagation) can't be steered
+// onto a peer's self-reported identity before it's had a chance to be
+// probed.
+func (b *AddrBook) VerifiedSample(n int) []Record {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	pool := make([]Record, 0, len(b.oldBucket))
+	for _, rec := range b.oldBucket {
+		pool = append(pool, rec)
+	}
+
+	rand.Shuffle(len(pool), func(i, j int) { pool[i], pool[j] = pool[j], pool[i] })
+	if n > len(pool) {
+		n = len(pool)
+	}
+	return pool[:n]
+}
+
+// OldEntries returns a copy of every verified ("old") record. The reactor's
+// reverification sweep does not use it: that sweep probes only "new" entries.
+func (b *AddrBook) OldEntries() []Record {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	out := make([]Record, 0, len(b.oldBucket))
+	for _, rec := range b.oldBucket {
+		out = append(out, rec)
+	}
+	return out
+}
+
+// NewEntries returns a copy of every unverified ("new") record.
+func (b *AddrBook) NewEntries() []Record {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	out := make([]Record, 0, len(b.newBucket))
+	for _, rec := range b.newBucket {
+		out = append(out, rec)
+	}
+	return out
+}
+
+// FindByAddress looks up a peer record by its host:port, preferring a
+// verified "old" bucket entry over an unverified "new" one when both exist.
+// It is used to recover the PKI-known public key for a destination address a
+// caller is about to dial, so the transport handshake can pin against it.
+func (b *AddrBook) FindByAddress(address string) (Record, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, rec := range b.oldBucket {
+		if rec.address() == address {
+			return rec, true
+		}
+	}
+	for _, rec := range b.newBucket {
+		if rec.address() == address {
+			return rec, true
+		}
+	}
+	return Record{}, false
+}
+
+// ErrUnknownPeer describes a peer id that is present in neither bucket. No
+// AddrBook method returns it: MarkGood and MarkFailed ignore unknown ids.
+var ErrUnknownPeer = errors.New("pex: unknown peer id")
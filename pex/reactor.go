@@ -0,0 +1,180 @@
+package pex
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// PexRequestFlag tags a PEX_REQUEST packet asking a peer for a sample of
+	// its address book.
+	PexRequestFlag = "\xA3"
+	// PexResponseFlag tags the PEX_RESPONSE reply carrying that sample.
+	PexResponseFlag = "\xA4"
+
+	probeTimeout  = 3 * time.Second
+	maxFailedSeen = 3
+)
+
+// Sender is the minimal capability the reactor needs from its host node to
+// push a PEX packet to a peer; ProviderServer.Send satisfies it.
+type Sender interface {
+	Send(packet []byte, address string) error
+}
+
+// Request is the body of a PEX_REQUEST packet.
+type Request struct {
+	RequesterId  string
+	ReplyAddress string
+}
+
+// Response is the body of a PEX_RESPONSE packet: a sample of records drawn
+// from the responder's address book.
+type Response struct {
+	Records []Record
+}
+
+// Reactor drives the peer exchange gossip loop for a single node: it answers
+// incoming PEX_REQUESTs, periodically asks connected peers for their own
+// samples on a Poisson timer, and re-verifies "new" entries by probing them.
+type Reactor struct {
+	Book         *AddrBook
+	SelfId       string
+	SelfAddress  string
+	PexRateParam float64 // rate (per second) of the exponential part of the wait between gossip rounds
+
+	sender Sender
+	quit   chan struct{}
+}
+
+// NewReactor constructs a Reactor that gossips on behalf of selfId/selfAddress
+// using book as its address store and sender to deliver PEX packets.
+func NewReactor(book *AddrBook, selfId, selfAddress string, sender Sender, pexRateParam float64) *Reactor {
+	return &Reactor{
+		Book:         book,
+		SelfId:       selfId,
+		SelfAddress:  selfAddress,
+		PexRateParam: pexRateParam,
+		sender:       sender,
+		quit:         make(chan struct{}),
+	}
+}
+
+// Start launches the background gossip and reverification goroutines. It
+// returns immediately; call Stop to terminate them.
+func (r *Reactor) Start() {
+	go r.gossipLoop()
+	go r.reverifyLoop()
+}
+
+// Stop terminates the reactor's background goroutines.
+func (r *Reactor) Stop() {
+	close(r.quit)
+}
+
+// HandleRequest answers a PEX_REQUEST with a PEX_RESPONSE packet addressed
+// back to the requester's advertised ReplyAddress.
+func (r *Reactor) HandleRequest(data []byte) error {
+	var req Request
+	if err := json.Unmarshal(data, &req); err != nil {
+		return err
+	}
+
+	sample := r.Book.Sample(DefaultSampleSize)
+	resp := Response{Records: sample}
+	respBytes, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+
+	return r.sender.Send([]byte(PexResponseFlag+string(respBytes)), req.ReplyAddress)
+}
+
+// HandleResponse merges the peer records carried by a PEX_RESPONSE into the
+// local "new" bucket.
+func (r *Reactor) HandleResponse(data []byte, sourceId string) error {
+	var resp Response
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return err
+	}
+	for _, rec := range resp.Records {
+		if rec.Id == r.SelfId {
+			continue
+		}
+		r.Book.AddAddress(rec, sourceId)
+	}
+	return nil
+}
+
+// gossipLoop issues PEX_REQUESTs to up to 3 known peers per round. The wait
+// between rounds is exponentially distributed with rate PexRateParam plus one
+// second, so request timing is not trivially predictable.
+func (r *Reactor) gossipLoop() {
+	for {
+		wait := time.Duration(rand.ExpFloat64()/r.PexRateParam*float64(time.Second)) + time.Second
+		select {
+		case <-time.After(wait):
+			r.requestFromRandomPeers(3)
+		case <-r.quit:
+			return
+		}
+	}
+}
+
+func (r *Reactor) requestFromRandomPeers(count int) {
+	peers := r.Book.Sample(count)
+	req := Request{RequesterId: r.SelfId, ReplyAddress: r.SelfAddress}
+	reqBytes, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+	for _, peer := range peers {
+		if err := r.sender.Send([]byte(PexRequestFlag+string(reqBytes)), peer.Host+":"+peer.Port); err != nil {
+			log.WithFields(log.Fields{"peer": peer.Id}).Warning("pex: request failed: ", err)
+			r.Book.MarkFailed(peer.Id, maxFailedSeen)
+		}
+	}
+}
+
+// reverifyLoop periodically probes "new" entries with a short TCP dial and
+// promotes the ones that answer to the "old" bucket.
+func (r *Reactor) reverifyLoop() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, rec := range r.Book.NewEntries() {
+				if probe(rec.address()) {
+					r.Book.MarkGood(rec.Id)
+				} else {
+					r.Book.MarkFailed(rec.Id, maxFailedSeen)
+				}
+			}
+		case <-r.quit:
+			return
+		}
+	}
+}
+
+func probe(address string) bool {
+	conn, err := net.DialTimeout("tcp", address, probeTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// Seed loads a hardcoded bootstrap list of provider addresses into the "new"
+// bucket, used on first start before any gossip has happened.
+func Seed(book *AddrBook, seeds []Record) {
+	for _, rec := range seeds {
+		book.AddAddress(rec, "seed")
+	}
+}
@@ -2,18 +2,26 @@ package server
 
 import (
 	"anonymous-messaging/node"
+	"crypto/ed25519"
 	"net"
 	"anonymous-messaging/networker"
-	"os"
 	"fmt"
 	"bytes"
 	"anonymous-messaging/config"
-	"io/ioutil"
+	"anonymous-messaging/discover"
 	"anonymous-messaging/helpers"
+	"anonymous-messaging/nat"
+	"anonymous-messaging/pex"
+	"anonymous-messaging/transport"
+	"anonymous-messaging/wal"
+	"encoding/json"
 	log "github.com/sirupsen/logrus"
 	"errors"
 	"anonymous-messaging/sphinx"
 	"github.com/protobuf/proto"
+	"strconv"
+	"sync"
+	"time"
 )
 
 const (
@@ -21,22 +29,56 @@ const (
 	COMM_FLAG = "\xC6"
 	TOKEN_FLAG = "xA9"
 	PULL_FLAG = "\xFF"
+	ACK_FLAG = "\xA5"
+
+	pexRateParameter = 0.2
+	natLeaseLifetime = 2 * time.Hour
 )
 
+// AckRequest is the body of an ACK_FLAG packet: it carries the id of the
+// last message the client successfully received, authenticated by the same
+// pull-request token used to authorize fetching the inbox in the first
+// place.
+type AckRequest struct {
+	ClientId string
+	Token    []byte
+	MsgId    string
+}
+
 type ProviderIt interface {
 	networker.NetworkServer
 	networker.NetworkClient
 }
 
 type ProviderServer struct {
-	Host string
-	Port string
+	// Host is the local address the listener binds to. AdvertiseHost is the
+	// address published into the PKI and gossiped over PEX - the two differ
+	// whenever the provider sits behind a NAT gateway, since the gateway's
+	// external IP is never one a local listener can bind to.
+	Host          string
+	AdvertiseHost string
+	Port          string
 	node.Mix
 	listener *net.TCPListener
 
 	assignedClients map[string]ClientRecord
 
+	// inboxMu guards inboxWALs and pendingAcks, both of which are read and
+	// written from the per-connection goroutines ListenForIncomingConnections
+	// starts to run HandleConnection for every accepted client; without it, two clients registering, pulling or
+	// acking close together race on a plain map write and crash the process.
+	inboxMu     sync.Mutex
+	inboxWALs   map[string]*wal.WAL
+	pendingAcks map[string]wal.Cursor
+
 	Config config.MixConfig
+
+	AddrBook  *pex.AddrBook
+	pexReactor *pex.Reactor
+	Discovery *discover.Service
+
+	natGateway nat.Interface
+	natQuit    chan struct{}
 }
 
 type ClientRecord struct {
@@ -67,6 +109,17 @@ func (p *ProviderServer) Run() {
 	defer p.listener.Close()
 	finish := make(chan bool)
 
+	p.pexReactor.Start()
+	defer p.pexReactor.Stop()
+
+	if p.natQuit != nil {
+		defer close(p.natQuit)
+	}
+
+	if p.Discovery != nil {
+		defer p.Discovery.Stop()
+	}
+
 	go func() {
 		log.WithFields(log.Fields{"id" : p.Id}).Info(fmt.Sprintf("Listening on %s", p.Host + ":" + p.Port))
 		p.ListenForIncomingConnections()
@@ -137,7 +190,7 @@ func (p *ProviderServer) ForwardPacket(sphinxPacket []byte, address string) erro
 */
 func (p *ProviderServer) Send(packet []byte, address string) error {
 
-	conn, err := net.Dial("tcp", address)
+	conn, err := transport.Dial(address, ed25519.PublicKey(p.PubKey), ed25519.PrivateKey(p.PrvKey), p.expectedPubFor(address))
 	if err != nil {
 		return err
 	}
@@ -147,6 +200,28 @@ func (p *ProviderServer) Send(packet []byte, address string) error {
 	return nil
 }
 
+// expectedPubFor recovers the PKI-known public key for address, the
+// destination a caller is about to dial, so Send can pin the transport
+// handshake against it instead of trusting whatever key the remote end
+// presents. It checks the provider's own registered clients first (address
+// reused from a client's assign request), then falls back to the PEX address
+// book. It returns nil - accept-anyone - only when the destination is not
+// yet known by either source, which degrades to the pre-handshake behaviour
+// rather than refusing to send.
+func (p *ProviderServer) expectedPubFor(address string) ed25519.PublicKey {
+	for _, client := range p.assignedClients {
+		if client.Host+":"+client.Port == address {
+			return ed25519.PublicKey(client.PubKey)
+		}
+	}
+	if p.AddrBook != nil {
+		if rec, ok := p.AddrBook.FindByAddress(address); ok {
+			return ed25519.PublicKey(rec.PubKey)
+		}
+	}
+	return nil
+}
+
 
 /*
 	Function responsible for running the listening process of the server;
@@ -179,18 +254,30 @@ func (p *ProviderServer) ListenForIncomingConnections() {
  */
 func (p *ProviderServer) HandleConnection(conn net.Conn, errs chan<- error) {
 
-	buff := make([]byte, 1024)
-	reqLen, err := conn.Read(buff)
-	defer conn.Close()
+	// expectedPeerPub is nil here because, unlike Send, the provider does not
+	// yet know which peer is on the other end of an inbound connection - that
+	// is exactly what the handshake and the packet's own flag (e.g. the
+	// client identity carried inside an ASSIGNE_FLAG registration) establish.
+	// Trust in the now-authenticated key is decided by the flag handler, not
+	// by this accept.
+	secureConn, err := transport.Accept(conn, ed25519.PublicKey(p.PubKey), ed25519.PrivateKey(p.PrvKey), nil)
+	if err != nil {
+		errs <- err
+		return
+	}
+	defer secureConn.Close()
 
+	buff, err := secureConn.ReadFrame()
 	if err != nil {
 		errs <- err
+		return
 	}
 
 	var packet config.GeneralPacket
-	err = proto.Unmarshal(buff[:reqLen], &packet)
+	err = proto.Unmarshal(buff, &packet)
 	if err != nil {
 		errs <- err
+		return
 	}
 
 	switch packet.Flag {
@@ -198,20 +285,42 @@ func (p *ProviderServer) HandleConnection(conn net.Conn, errs chan<- error) {
 		err = p.HandleAssignRequest(packet.Data)
 		if err != nil {
 			errs <- err
+			return
 		}
 	case COMM_FLAG:
 		err = p.ReceivedPacket(packet.Data)
 		if err != nil {
 			errs <- err
+			return
 		}
 	case PULL_FLAG:
 		err = p.HandlePullRequest(packet.Data)
 		if err != nil{
 			errs <- err
+			return
+		}
+	case ACK_FLAG:
+		err = p.HandleAck(packet.Data)
+		if err != nil{
+			errs <- err
+			return
+		}
+	case pex.PexRequestFlag:
+		err = p.pexReactor.HandleRequest(packet.Data)
+		if err != nil{
+			errs <- err
+			return
+		}
+	case pex.PexResponseFlag:
+		err = p.pexReactor.HandleResponse(packet.Data, "")
+		if err != nil{
+			errs <- err
+			return
 		}
 	default:
 		log.WithFields(log.Fields{"id" : p.Id}).Info("Packet flag not recognised. Packet dropped")
 		errs <- nil
+		return
 	}
 	errs <- nil
 }
@@ -234,20 +343,35 @@ func (p *ProviderServer) RegisterNewClient(clientBytes []byte) ([]byte, string,
 	p.assignedClients[clientConf.Id] = record
 	address := clientConf.Host + ":" + clientConf.Port
 
-	path := fmt.Sprintf("./inboxes/%s", clientConf.Id)
-	exists, err := helpers.DirExists(path)
-	if err != nil{
+	// Opening (or re-opening, on a reconnect after a crash) the inbox WAL
+	// here creates the inbox directory and truncates any record torn by a
+	// crash. FetchMessages resumes from the persisted cursor, so in-flight
+	// undelivered messages are picked up again on the next pull request.
+	if _, err := p.inboxWAL(clientConf.Id); err != nil {
 		return nil, "", err
 	}
-	if exists == false {
-		if err := os.MkdirAll(path, 0775); err != nil {
-			return nil, "", err
-		}
-	}
 
 	return token, address, nil
 }
 
+// inboxWAL returns the write-ahead log for a client's inbox, opening it on
+// first use.
+func (p *ProviderServer) inboxWAL(clientId string) (*wal.WAL, error) {
+	p.inboxMu.Lock()
+	defer p.inboxMu.Unlock()
+
+	if w, ok := p.inboxWALs[clientId]; ok {
+		return w, nil
+	}
+
+	w, err := wal.Open(fmt.Sprintf("./inboxes/%s", clientId), wal.DefaultMaxSegmentSize)
+	if err != nil {
+		return nil, err
+	}
+	p.inboxWALs[clientId] = w
+	return w, nil
+}
+
 /*
 	Function is responsible for handling the registration request from the client.
 	it registers the client in the list of all registered clients and send
@@ -321,40 +445,42 @@ func (p *ProviderServer) AuthenticateUser(clientId string, clientToken []byte) b
 }
 
 /*
-	FetchMessages fetches messages from the requested inbox.
-	FetchMessages checks whether an inbox exists and if it contains
-	stored messages. If inbox contains any stored messages, all of them
-	are send to the client one by one. FetchMessages returns a code
-	signaling whether (NI) inbox does not exist, (EI) inbox is empty,
-	(SI) messages were send to the client; and an error.
+	FetchMessages fetches messages from the requested inbox's write-ahead log,
+	starting at the client's last-acknowledged cursor. FetchMessages returns a
+	code signaling whether (NI) the client is not registered, (EI) the inbox
+	has nothing unacknowledged, (SI) messages were sent to the client; and an
+	error. The read cursor is NOT advanced here: it only moves once the
+	client's ACK_FLAG for these messages is handled, so a crash between
+	sending and acking redelivers rather than drops them.
 */
 func (p *ProviderServer) FetchMessages(clientId string) (string, error){
 
-	path := fmt.Sprintf("./inboxes/%s", clientId)
-	exist, err := helpers.DirExists(path)
-	if err != nil{
+	if _, registered := p.assignedClients[clientId]; !registered {
+		return "NI", nil
+	}
+
+	w, err := p.inboxWAL(clientId)
+	if err != nil {
 		return "", err
 	}
-	if exist == false{
-		return "NI", nil
+
+	cursor, err := w.LoadCursor()
+	if err != nil {
+		return "", err
 	}
-	files, err := ioutil.ReadDir(path)
-	if err != nil{
+
+	records, newCursor, err := w.ReadFrom(cursor)
+	if err != nil {
 		return "", err
 	}
-	if len(files) == 0 {
+	if len(records) == 0 {
 		return "EI", nil
 	}
 
-	for _, f := range files {
-		dat, err := ioutil.ReadFile(path + "/" + f.Name())
-		if err !=nil {
-			return "", err
-		}
-
-		address := p.assignedClients[clientId].Host + ":" + p.assignedClients[clientId].Port
+	address := p.assignedClients[clientId].Host + ":" + p.assignedClients[clientId].Port
+	for _, record := range records {
 		log.WithFields(log.Fields{"id" : p.Id}).Info(fmt.Sprintf("Found stored message for address %s", address))
-		msgBytes, err := config.WrapWithFlag(COMM_FLAG, dat)
+		msgBytes, err := config.WrapWithFlag(COMM_FLAG, record.Payload)
 		if err !=nil {
 			return "", err
 		}
@@ -363,42 +489,179 @@ func (p *ProviderServer) FetchMessages(clientId string) (string, error){
 			return "", err
 		}
 	}
+
+	p.inboxMu.Lock()
+	p.pendingAcks[clientId] = newCursor
+	p.inboxMu.Unlock()
 	return "SI", nil
 }
 
 /*
-	StoreMessage saves the given message in the inbox defined by the given id.
-	If the inbox address does not exist or writing into the inbox was unsuccessful
-	the function returns an error
+	StoreMessage appends the given message to the inbox WAL defined by the
+	given id, fsyncing before returning. If the append was unsuccessful the
+	function returns an error.
 */
 func (p *ProviderServer) StoreMessage(message []byte, inboxId string, messageId string) error {
-	path := fmt.Sprintf("./inboxes/%s", inboxId)
-	fileName := path + "/" + messageId + ".txt"
+	w, err := p.inboxWAL(inboxId)
+	if err != nil {
+		return err
+	}
+
+	if err := w.Append(messageId, message); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{"id" : p.Id}).Info(fmt.Sprintf(" Stored message for %s", inboxId))
+	return nil
+}
+
+/*
+	HandleAck processes an ACK_FLAG packet: once the client's token is
+	verified, the inbox's read cursor is advanced past the batch of messages
+	that was fetched, and any now fully-acknowledged WAL segments are
+	recycled.
+*/
+func (p *ProviderServer) HandleAck(data []byte) error {
+	var ack AckRequest
+	if err := json.Unmarshal(data, &ack); err != nil {
+		return err
+	}
+
+	if !p.AuthenticateUser(ack.ClientId, ack.Token) {
+		log.WithFields(log.Fields{"id" : p.Id}).Warning("Authentication went wrong")
+		return errors.New("authentication went wrong")
+	}
+
+	p.inboxMu.Lock()
+	cursor, pending := p.pendingAcks[ack.ClientId]
+	p.inboxMu.Unlock()
+	if !pending {
+		return nil
+	}
 
-	file, err := os.Create(fileName)
+	w, err := p.inboxWAL(ack.ClientId)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	if err := w.Ack(cursor); err != nil {
+		return err
+	}
+
+	p.inboxMu.Lock()
+	delete(p.pendingAcks, ack.ClientId)
+	p.inboxMu.Unlock()
+	log.WithFields(log.Fields{"id" : p.Id}).Info(fmt.Sprintf("Inbox cursor for %s acknowledged up to msg %s", ack.ClientId, ack.MsgId))
+	return nil
+}
 
-	_, err = file.Write(message)
+/*
+	mapNATPort requests an external port mapping matching the provider's
+	listener port, discovers the gateway's external IP and sets
+	providerServer.AdvertiseHost so that the PKI record published afterwards
+	carries the externally reachable address. It deliberately leaves Host -
+	the address the listener binds to - untouched: the gateway's external IP
+	is not, in general, assigned to any local interface, so binding to it
+	would fail on a typical home NAT. It also starts a background goroutine
+	that renews the lease every natLeaseLifetime/2, stopped when natQuit is
+	closed by Run.
+*/
+func (p *ProviderServer) mapNATPort() error {
+	port, err := strconv.Atoi(p.Port)
 	if err != nil {
 		return err
 	}
 
-	log.WithFields(log.Fields{"id" : p.Id}).Info(fmt.Sprintf(" Stored message for %s", inboxId))
+	if err := p.natGateway.AddMapping("tcp", port, port, "loopix-provider-"+p.Id, natLeaseLifetime); err != nil {
+		return err
+	}
+
+	externalIP, err := p.natGateway.ExternalIP()
+	if err != nil {
+		return err
+	}
+	p.AdvertiseHost = externalIP
+	p.natQuit = make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(natLeaseLifetime / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := p.natGateway.AddMapping("tcp", port, port, "loopix-provider-"+p.Id, natLeaseLifetime); err != nil {
+					log.WithFields(log.Fields{"id": p.Id}).Warning("nat: failed to renew port mapping: ", err)
+				}
+			case <-p.natQuit:
+				if err := p.natGateway.DeleteMapping("tcp", port); err != nil {
+					log.WithFields(log.Fields{"id": p.Id}).Warning("nat: failed to release port mapping: ", err)
+				}
+				return
+			}
+		}
+	}()
 	return nil
 }
 
 /*
-	NewProviderServer constructs a new provider object.
+	NewProviderServer constructs a new provider object. When gateway is
+	non-nil, it is used to map the listening port on the local NAT and to
+	discover the external address published into the PKI; pass nil to publish
+	host/port as-is. When udpPort is non-empty, the provider also joins the
+	Kademlia discovery DHT on host:udpPort and seeds its routing table from
+	seeds, so a client can find this provider by id without ever having
+	preloaded it from the PKI; pass "" and nil to leave discovery off.
 	Function returns a new provider object and an error.
 */
-func NewProviderServer(id string, host string, port string, pubKey []byte, prvKey []byte, pkiPath string) (*ProviderServer, error) {
+func NewProviderServer(id string, host string, port string, pubKey []byte, prvKey []byte, pkiPath string, gateway nat.Interface, udpPort string, seeds []discover.Node) (*ProviderServer, error) {
 	node := node.Mix{Id: id, PubKey: pubKey, PrvKey: prvKey}
-	providerServer := ProviderServer{Host: host, Port: port, Mix: node, listener: nil}
-	providerServer.Config = config.MixConfig{Id: providerServer.Id, Host: providerServer.Host, Port: providerServer.Port, PubKey: providerServer.PubKey}
+	providerServer := ProviderServer{Host: host, AdvertiseHost: host, Port: port, Mix: node, listener: nil}
+	providerServer.natGateway = gateway
+
+	if gateway != nil {
+		if err := providerServer.mapNATPort(); err != nil {
+			log.WithFields(log.Fields{"id": id}).Warning("nat: falling back to configured host: ", err)
+			providerServer.natGateway = nil
+		}
+	}
+
+	providerServer.Config = config.MixConfig{Id: providerServer.Id, Host: providerServer.AdvertiseHost, Port: providerServer.Port, PubKey: providerServer.PubKey}
 	providerServer.assignedClients = make(map[string]ClientRecord)
+	providerServer.inboxWALs = make(map[string]*wal.WAL)
+	providerServer.pendingAcks = make(map[string]wal.Cursor)
+
+	addrBook, err := pex.NewAddrBook(fmt.Sprintf("./addrbooks/%s.json", id))
+	if err != nil{
+		return nil, err
+	}
+	providerServer.AddrBook = addrBook
+	providerServer.pexReactor = pex.NewReactor(addrBook, id, providerServer.AdvertiseHost+":"+providerServer.Port, &providerServer, pexRateParameter)
+
+	if udpPort != "" {
+		tcpPort, err := strconv.Atoi(providerServer.Port)
+		if err != nil {
+			return nil, err
+		}
+		udpPortNum, err := strconv.Atoi(udpPort)
+		if err != nil {
+			return nil, err
+		}
+		self := discover.Node{
+			ID:      discover.IdFromPubKey(pubKey),
+			IP:      net.ParseIP(providerServer.AdvertiseHost),
+			UDPPort: udpPortNum,
+			TCPPort: tcpPort,
+			PubKey:  pubKey,
+		}
+		service, err := discover.Listen(self, host+":"+udpPort)
+		if err != nil {
+			return nil, err
+		}
+		service.Start()
+		if len(seeds) > 0 {
+			service.Bootstrap(seeds)
+		}
+		providerServer.Discovery = service
+	}
 
 	configBytes, err := proto.Marshal(&providerServer.Config)
 	if err != nil{
@@ -0,0 +1,305 @@
+/*
+	Package transport implements an authenticated, encrypted hop-to-hop link
+	between mix nodes and clients. It wraps a plain net.Conn with an ephemeral
+	Diffie-Hellman handshake (X25519) followed by an Ed25519 signature over the
+	handshake transcript, so that every link is confidential and endpoint
+	authenticated, independently of the onion encryption already performed by
+	the Sphinx packet format.
+*/
+package transport
+
+import (
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"anonymous-messaging/frame"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// maxSealedPayload bounds any single plaintext frame, handshake or data,
+	// so its ciphertext still fits under frame.MaxFrameLength. A SecretConn
+	// never truncates a large Sphinx packet the way the original 1024-byte
+	// conn.Read buffer did.
+	maxSealedPayload = frame.MaxFrameLength - chacha20poly1305.Overhead
+	hkdfInfo         = "anonymous-messaging-transport"
+)
+
+// SecretConn wraps a net.Conn and transparently seals/opens every frame with
+// a per-direction ChaCha20-Poly1305 key derived during the handshake.
+type SecretConn struct {
+	conn net.Conn
+
+	sendCipher cipher.AEAD
+	recvCipher cipher.AEAD
+	sendNonce  uint64
+	recvNonce  uint64
+
+	localPubKey  ed25519.PublicKey
+	RemotePubKey ed25519.PublicKey
+}
+
+// handshakeMsg is the payload exchanged under the derived key once the
+// ephemeral DH exchange is complete: the sender's long-term identity key and
+// a signature proving ownership of it over the handshake transcript.
+type handshakeMsg struct {
+	LongTermPub []byte
+	Signature   []byte
+}
+
+// Dial opens a TCP connection to address and performs the SecretConnection
+// handshake as the initiating party. expectedPeerPub, if non-nil, is the
+// peer's long-term public key as known from the PKI; the handshake fails if
+// the remote does not prove ownership of that exact key.
+func Dial(address string, localPub ed25519.PublicKey, localPriv ed25519.PrivateKey, expectedPeerPub ed25519.PublicKey) (*SecretConn, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	sc, err := handshake(conn, localPub, localPriv, expectedPeerPub)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return sc, nil
+}
+
+// Accept performs the SecretConnection handshake as the responding party
+// over an already-accepted net.Conn.
+func Accept(conn net.Conn, localPub ed25519.PublicKey, localPriv ed25519.PrivateKey, expectedPeerPub ed25519.PublicKey) (*SecretConn, error) {
+	return handshake(conn, localPub, localPriv, expectedPeerPub)
+}
+
+// Handshake runs the (symmetric) SecretConnection handshake over conn
+// directly, for callers - such as tests - that already have a net.Conn from
+// something other than Dial/Accept, e.g. one wrapped for fault injection.
+func Handshake(conn net.Conn, localPub ed25519.PublicKey, localPriv ed25519.PrivateKey, expectedPeerPub ed25519.PublicKey) (*SecretConn, error) {
+	return handshake(conn, localPub, localPriv, expectedPeerPub)
+}
+
+func handshake(conn net.Conn, localPub ed25519.PublicKey, localPriv ed25519.PrivateKey, expectedPeerPub ed25519.PublicKey) (*SecretConn, error) {
+	var localEphPriv [32]byte
+	if _, err := io.ReadFull(rand.Reader, localEphPriv[:]); err != nil {
+		return nil, err
+	}
+	localEphPub, err := curve25519.X25519(localEphPriv[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(localEphPub); err != nil {
+		return nil, err
+	}
+	remoteEphPub := make([]byte, 32)
+	if _, err := io.ReadFull(conn, remoteEphPub); err != nil {
+		return nil, err
+	}
+
+	shared, err := curve25519.X25519(localEphPriv[:], remoteEphPub)
+	if err != nil {
+		return nil, err
+	}
+
+	transcript := challengeHash(localEphPub, remoteEphPub)
+	loSend, loRecv := deriveDirectionalKeys(shared, transcript, localEphPub, remoteEphPub)
+
+	sendCipher, err := chacha20poly1305.New(loSend)
+	if err != nil {
+		return nil, err
+	}
+	recvCipher, err := chacha20poly1305.New(loRecv)
+	if err != nil {
+		return nil, err
+	}
+
+	sc := &SecretConn{
+		conn:        conn,
+		sendCipher:  sendCipher,
+		recvCipher:  recvCipher,
+		localPubKey: localPub,
+	}
+
+	signature := ed25519.Sign(localPriv, transcript)
+	ownMsg := handshakeMsg{LongTermPub: localPub, Signature: signature}
+	if err := sc.writeHandshakeMsg(ownMsg); err != nil {
+		return nil, err
+	}
+
+	peerMsg, err := sc.readHandshakeMsg()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(peerMsg.LongTermPub) != ed25519.PublicKeySize {
+		return nil, errors.New("transport: malformed handshake message")
+	}
+	peerPub := ed25519.PublicKey(peerMsg.LongTermPub)
+	if !ed25519.Verify(peerPub, transcript, peerMsg.Signature) {
+		return nil, errors.New("transport: invalid handshake signature")
+	}
+	if expectedPeerPub != nil && !publicKeyEqual(peerPub, expectedPeerPub) {
+		return nil, errors.New("transport: peer identity key does not match PKI record")
+	}
+
+	sc.RemotePubKey = peerPub
+	return sc, nil
+}
+
+// challengeHash computes a transcript binding of the two ephemeral public
+// keys, sorted lexicographically so both parties compute the same value
+// regardless of role.
+func challengeHash(a, b []byte) []byte {
+	first, second := a, b
+	if bytesCompare(a, b) > 0 {
+		first, second = b, a
+	}
+	h := sha256.New()
+	h.Write(first)
+	h.Write(second)
+	return h.Sum(nil)
+}
+
+func bytesCompare(a, b []byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(a) - len(b)
+}
+
+func publicKeyEqual(a, b ed25519.PublicKey) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// deriveDirectionalKeys expands the shared secret into two independent
+// ChaCha20-Poly1305 keys, one per direction. The party with the
+// lexicographically smaller ephemeral public key always sends on the first
+// derived key, so both ends agree on which key encrypts which direction.
+func deriveDirectionalKeys(shared, transcript, localEphPub, remoteEphPub []byte) (sendKey, recvKey []byte) {
+	kdf := hkdf.New(sha256.New, shared, transcript, []byte(hkdfInfo))
+	keyA := make([]byte, chacha20poly1305.KeySize)
+	keyB := make([]byte, chacha20poly1305.KeySize)
+	io.ReadFull(kdf, keyA)
+	io.ReadFull(kdf, keyB)
+
+	if bytesCompare(localEphPub, remoteEphPub) < 0 {
+		return keyA, keyB
+	}
+	return keyB, keyA
+}
+
+func nonceBytes(counter uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+func (sc *SecretConn) writeHandshakeMsg(msg handshakeMsg) error {
+	plaintext := append(append([]byte{byte(len(msg.LongTermPub))}, msg.LongTermPub...), msg.Signature...)
+	return sc.writeSealed(sc.sendCipher, &sc.sendNonce, plaintext)
+}
+
+func (sc *SecretConn) readHandshakeMsg() (handshakeMsg, error) {
+	plaintext, err := sc.readSealed(sc.recvCipher, &sc.recvNonce)
+	if err != nil {
+		return handshakeMsg{}, err
+	}
+	if len(plaintext) < 1 {
+		return handshakeMsg{}, errors.New("transport: malformed handshake message")
+	}
+	pubLen := int(plaintext[0])
+	if len(plaintext) < 1+pubLen {
+		return handshakeMsg{}, errors.New("transport: malformed handshake message")
+	}
+	return handshakeMsg{
+		LongTermPub: plaintext[1 : 1+pubLen],
+		Signature:   plaintext[1+pubLen:],
+	}, nil
+}
+
+// writeSealed seals plaintext and sends it as a single length-prefixed
+// frame.Write frame, so the receiver's frame.Read always gets the whole
+// ciphertext in one shot regardless of how TCP happens to segment it.
+func (sc *SecretConn) writeSealed(aead cipher.AEAD, counter *uint64, plaintext []byte) error {
+	if len(plaintext) > maxSealedPayload {
+		return errors.New("transport: plaintext too large for a single sealed frame")
+	}
+
+	sealed := aead.Seal(nil, nonceBytes(*counter), plaintext, nil)
+	*counter++
+
+	return frame.Write(sc.conn, sealed)
+}
+
+func (sc *SecretConn) readSealed(aead cipher.AEAD, counter *uint64) ([]byte, error) {
+	sealed, err := frame.Read(sc.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := aead.Open(nil, nonceBytes(*counter), sealed, nil)
+	if err != nil {
+		return nil, err
+	}
+	*counter++
+	return plaintext, nil
+}
+
+// Write seals b as a single AEAD frame and sends it over the underlying
+// connection.
+func (sc *SecretConn) Write(b []byte) (int, error) {
+	if err := sc.writeSealed(sc.sendCipher, &sc.sendNonce, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Read returns the next AEAD-sealed frame's plaintext, copying as much of it
+// as fits into b. Callers that need the whole frame regardless of buffer size
+// should size b generously; ReadFrame returns the frame unabridged.
+func (sc *SecretConn) Read(b []byte) (int, error) {
+	plaintext, err := sc.readSealed(sc.recvCipher, &sc.recvNonce)
+	if err != nil {
+		return 0, err
+	}
+	return copy(b, plaintext), nil
+}
+
+// ReadFrame returns the next decrypted frame in full, regardless of size.
+func (sc *SecretConn) ReadFrame() ([]byte, error) {
+	return sc.readSealed(sc.recvCipher, &sc.recvNonce)
+}
+
+// Close closes the underlying connection.
+func (sc *SecretConn) Close() error {
+	return sc.conn.Close()
+}
+
+func (sc *SecretConn) LocalAddr() net.Addr  { return sc.conn.LocalAddr() }
+func (sc *SecretConn) RemoteAddr() net.Addr { return sc.conn.RemoteAddr() }
+
+func (sc *SecretConn) SetDeadline(t time.Time) error      { return sc.conn.SetDeadline(t) }
+func (sc *SecretConn) SetReadDeadline(t time.Time) error  { return sc.conn.SetReadDeadline(t) }
+func (sc *SecretConn) SetWriteDeadline(t time.Time) error { return sc.conn.SetWriteDeadline(t) }
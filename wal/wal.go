@@ -0,0 +1,381 @@
+/*
+	Package wal implements a durable, crash-safe, append-only write-ahead log
+	used for provider inboxes. Each inbox gets its own WAL of rotating
+	segments; messages are appended with an fsync before StoreMessage returns,
+	and FetchMessages only advances its read cursor once the client has
+	acknowledged receipt, so a crash between append and ack can at worst
+	redeliver a message, never drop or reorder one.
+*/
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxSegmentSize is the size at which a segment is rotated.
+	DefaultMaxSegmentSize = 16 * 1024 * 1024
+
+	segmentPrefix = "wal-"
+	segmentSuffix = ".log"
+	cursorFile    = "cursor.json"
+)
+
+// Record is one decoded WAL entry.
+type Record struct {
+	MsgId     string
+	Payload   []byte
+	Timestamp time.Time
+}
+
+// Cursor identifies a read position in the log: a segment file and a byte
+// offset within it. The zero Cursor means "start of the log".
+type Cursor struct {
+	Segment string `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+// WAL is an append-only, segmented write-ahead log rooted at a directory.
+type WAL struct {
+	dir            string
+	maxSegmentSize int64
+
+	mu           sync.Mutex
+	currentFile  *os.File
+	currentIndex int
+	currentSize  int64
+}
+
+// Open creates dir if needed and opens (or creates) its write-ahead log,
+// appending to the most recent segment.
+func Open(dir string, maxSegmentSize int64) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return nil, err
+	}
+	if maxSegmentSize <= 0 {
+		maxSegmentSize = DefaultMaxSegmentSize
+	}
+
+	indices, err := segmentIndices(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &WAL{dir: dir, maxSegmentSize: maxSegmentSize}
+	index := 0
+	if len(indices) > 0 {
+		index = indices[len(indices)-1]
+		// Only the most recently written segment can still be mid-append
+		// when the process crashes; every earlier segment was already
+		// closed (rotated away from) before that happened.
+		if err := truncateTornTail(segmentPath(dir, index)); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.openSegment(index); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// truncateTornTail scans path record by record and truncates the file back
+// to the end of the last fully-written, checksum-valid record. A crash
+// mid-Append can leave a torn header or body at the end of the most recent
+// segment; left in place, O_APPEND would write new, valid records right
+// after that garbage, and decodeRecord's next read would parse the torn
+// header's bogus length, over-read into the new records, and silently treat
+// the result as end-of-log - discarding everything written after reopening.
+// Truncating the torn tail before resuming appends makes that impossible.
+func truncateTornTail(path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0664)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var validSize int64
+	for {
+		_, n, err := decodeRecord(reader)
+		if err != nil {
+			break
+		}
+		validSize += n
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == validSize {
+		return nil
+	}
+	return file.Truncate(validSize)
+}
+
+func segmentPath(dir string, index int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%06d%s", segmentPrefix, index, segmentSuffix))
+}
+
+func segmentIndices(dir string) ([]int, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var indices []int
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		numPart := strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix)
+		index, err := strconv.Atoi(numPart)
+		if err != nil {
+			continue
+		}
+		indices = append(indices, index)
+	}
+	sort.Ints(indices)
+	return indices, nil
+}
+
+func (w *WAL) openSegment(index int) error {
+	file, err := os.OpenFile(segmentPath(w.dir, index), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0664)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	w.currentFile = file
+	w.currentIndex = index
+	w.currentSize = info.Size()
+	return nil
+}
+
+// Append writes msgId/payload as a new record, fsyncing before returning so
+// that a successful Append is durable across a crash.
+func (w *WAL) Append(msgId string, payload []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	body := encodeBody(msgId, payload, time.Now())
+	record := encodeRecord(body)
+
+	if w.currentSize+int64(len(record)) > w.maxSegmentSize && w.currentSize > 0 {
+		if err := w.currentFile.Close(); err != nil {
+			return err
+		}
+		if err := w.openSegment(w.currentIndex + 1); err != nil {
+			return err
+		}
+	}
+
+	if _, err := w.currentFile.Write(record); err != nil {
+		return err
+	}
+	if err := w.currentFile.Sync(); err != nil {
+		return err
+	}
+	w.currentSize += int64(len(record))
+	return nil
+}
+
+// encodeRecord lays a record out as [crc32(4) | len(4) | body], where body is
+// [timestamp(8) | msgIdLen(2) | msgId | payload].
+func encodeRecord(body []byte) []byte {
+	crc := crc32.ChecksumIEEE(body)
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header[0:4], crc)
+	binary.BigEndian.PutUint32(header[4:8], uint32(len(body)))
+	return append(header, body...)
+}
+
+func encodeBody(msgId string, payload []byte, ts time.Time) []byte {
+	body := make([]byte, 8+2+len(msgId)+len(payload))
+	binary.BigEndian.PutUint64(body[0:8], uint64(ts.UnixNano()))
+	binary.BigEndian.PutUint16(body[8:10], uint16(len(msgId)))
+	copy(body[10:10+len(msgId)], msgId)
+	copy(body[10+len(msgId):], payload)
+	return body
+}
+
+func decodeRecord(r *bufio.Reader) (Record, int64, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return Record{}, 0, err
+	}
+	crc := binary.BigEndian.Uint32(header[0:4])
+	bodyLen := binary.BigEndian.Uint32(header[4:8])
+
+	body := make([]byte, bodyLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return Record{}, 0, err
+	}
+	if crc32.ChecksumIEEE(body) != crc {
+		return Record{}, 0, errors.New("wal: checksum mismatch, segment corrupt")
+	}
+
+	ts := time.Unix(0, int64(binary.BigEndian.Uint64(body[0:8])))
+	msgIdLen := binary.BigEndian.Uint16(body[8:10])
+	msgId := string(body[10 : 10+msgIdLen])
+	payload := body[10+msgIdLen:]
+
+	return Record{MsgId: msgId, Payload: payload, Timestamp: ts}, int64(8 + len(body)), nil
+}
+
+// ReadFrom reads every record available after cursor, across as many
+// segments as necessary, and returns the records read along with the cursor
+// positioned just past the last one. Callers must not advance the persisted
+// cursor until the records have actually been delivered and acknowledged.
+func (w *WAL) ReadFrom(cursor Cursor) ([]Record, Cursor, error) {
+	w.mu.Lock()
+	indices, err := segmentIndices(w.dir)
+	w.mu.Unlock()
+	if err != nil {
+		return nil, cursor, err
+	}
+	if len(indices) == 0 {
+		return nil, cursor, nil
+	}
+
+	startIndex := indices[0]
+	startOffset := int64(0)
+	if cursor.Segment != "" {
+		if idx, err := indexFromSegmentName(cursor.Segment); err == nil {
+			startIndex = idx
+			startOffset = cursor.Offset
+		}
+	}
+
+	var records []Record
+	lastCursor := cursor
+
+	for _, index := range indices {
+		if index < startIndex {
+			continue
+		}
+		offset := int64(0)
+		if index == startIndex {
+			offset = startOffset
+		}
+
+		read, newOffset, err := readSegmentFrom(segmentPath(w.dir, index), offset)
+		if err != nil {
+			return nil, lastCursor, err
+		}
+		records = append(records, read...)
+		if len(read) > 0 || newOffset != offset {
+			lastCursor = Cursor{Segment: filepath.Base(segmentPath(w.dir, index)), Offset: newOffset}
+		}
+	}
+
+	return records, lastCursor, nil
+}
+
+func readSegmentFrom(path string, offset int64) ([]Record, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, offset, err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, offset, err
+	}
+
+	reader := bufio.NewReader(file)
+	var records []Record
+	pos := offset
+	for {
+		record, n, err := decodeRecord(reader)
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, pos, err
+		}
+		records = append(records, record)
+		pos += n
+	}
+	return records, pos, nil
+}
+
+func indexFromSegmentName(name string) (int, error) {
+	numPart := strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix)
+	return strconv.Atoi(numPart)
+}
+
+// LoadCursor returns the persisted read cursor, or the zero Cursor if none
+// has been saved yet.
+func (w *WAL) LoadCursor() (Cursor, error) {
+	data, err := ioutil.ReadFile(filepath.Join(w.dir, cursorFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Cursor{}, nil
+		}
+		return Cursor{}, err
+	}
+	var cursor Cursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return Cursor{}, err
+	}
+	return cursor, nil
+}
+
+// Ack persists cursor as the new read position and recycles (deletes) any
+// segment files that precede it, since every record they contain has now
+// been acknowledged by the client.
+func (w *WAL) Ack(cursor Cursor) error {
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(w.dir, cursorFile), data, 0664); err != nil {
+		return err
+	}
+
+	ackedIndex, err := indexFromSegmentName(cursor.Segment)
+	if err != nil {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	indices, err := segmentIndices(w.dir)
+	if err != nil {
+		return err
+	}
+	for _, index := range indices {
+		if index < ackedIndex && index != w.currentIndex {
+			os.Remove(segmentPath(w.dir, index))
+		}
+	}
+	return nil
+}
+
+// Close closes the currently open segment file.
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.currentFile.Close()
+}